@@ -0,0 +1,277 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitindex
+
+import (
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/zoekt"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// newTestRepo creates a small git repository in a temporary directory
+// with a single commit, a branch and a tag, and returns its path.
+func newTestRepo(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+	}
+
+	run("init", "-q", "-b", "master")
+	if err := os.WriteFile(filepath.Join(dir, "f.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run("add", "f.txt")
+	run("commit", "-q", "-m", "initial")
+	run("tag", "v1.0.0")
+	run("branch", "dev")
+
+	return dir
+}
+
+func TestRegisterOriginMatcherTrimGitSuffix(t *testing.T) {
+	RegisterOriginMatcher(func(u *url.URL) bool {
+		return u.Host == "git.internal.example.com"
+	}, "cgit", false)
+
+	u, err := url.Parse("https://git.internal.example.com/lilypond.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var desc zoekt.Repository
+	if err := SetTemplatesFromOrigin(&desc, u); err != nil {
+		t.Fatal(err)
+	}
+
+	const want = "https://git.internal.example.com/lilypond.git/tree/{{.Path}}/?id={{.Version}}"
+	if desc.FileURLTemplate != want {
+		t.Errorf("FileURLTemplate = %q, want %q (custom cgit matcher must not lose the .git suffix)", desc.FileURLTemplate, want)
+	}
+}
+
+func TestSetTemplatesAzureDevOpsLineNumberIsQueryParam(t *testing.T) {
+	u, err := url.Parse("https://dev.azure.com/org/project/_git/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var desc zoekt.Repository
+	if err := SetTemplatesFromOrigin(&desc, u); err != nil {
+		t.Fatal(err)
+	}
+
+	if desc.LineFragmentTemplate != "" {
+		t.Errorf("LineFragmentTemplate = %q, want empty (Azure DevOps embeds the line number in FileURLTemplate instead)", desc.LineFragmentTemplate)
+	}
+	if !strings.Contains(desc.FileURLTemplate, "&line={{.LineNumber}}") {
+		t.Errorf("FileURLTemplate = %q, want it to contain the line number as a query parameter", desc.FileURLTemplate)
+	}
+	if strings.Contains(desc.FileURLTemplate, "#") {
+		t.Errorf("FileURLTemplate = %q, must not rely on a URL fragment for the line number", desc.FileURLTemplate)
+	}
+}
+
+func TestGitAttributesMatcher(t *testing.T) {
+	m := parseGitAttributes(strings.Join([]string{
+		"# comment, ignored",
+		"vendor/** linguist-vendored",
+		"*.min.js linguist-generated",
+		"vendor/keep.go -linguist-vendored",
+		"ignored.bin export-ignore",
+	}, "\n"))
+
+	cases := []struct {
+		path     string
+		wantSkip bool
+		wantTags []string
+	}{
+		{"vendor/lib.go", false, []string{"linguist-vendored"}},
+		{"vendor/sub/dir/lib.go", false, []string{"linguist-vendored"}},
+		{"vendor/keep.go", false, nil},
+		{"app.min.js", false, []string{"linguist-generated"}},
+		{"ignored.bin", true, nil},
+		{"main.go", false, nil},
+	}
+
+	for _, c := range cases {
+		if got := m.matches(c.path, []string{"export-ignore"}); got != c.wantSkip {
+			t.Errorf("matches(%q, [export-ignore]) = %v, want %v", c.path, got, c.wantSkip)
+		}
+		got := m.attrsFor(c.path, []string{"linguist-vendored", "linguist-generated"})
+		if len(got) != len(c.wantTags) {
+			t.Errorf("attrsFor(%q) = %v, want %v", c.path, got, c.wantTags)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.wantTags[i] {
+				t.Errorf("attrsFor(%q) = %v, want %v", c.path, got, c.wantTags)
+				break
+			}
+		}
+	}
+}
+
+func TestDiffTreeEntries(t *testing.T) {
+	oldEntries := []TreeEntry{
+		{Path: "unchanged.txt", Hash: plumbing.NewHash("1111111111111111111111111111111111111111")},
+		{Path: "modified.txt", Hash: plumbing.NewHash("2222222222222222222222222222222222222222")},
+		{Path: "removed.txt", Hash: plumbing.NewHash("3333333333333333333333333333333333333333")},
+	}
+	newEntries := []TreeEntry{
+		{Path: "unchanged.txt", Hash: plumbing.NewHash("1111111111111111111111111111111111111111")},
+		{Path: "modified.txt", Hash: plumbing.NewHash("4444444444444444444444444444444444444444")},
+		{Path: "added.txt", Hash: plumbing.NewHash("5555555555555555555555555555555555555555")},
+	}
+
+	added, removed := diffTreeEntries(oldEntries, newEntries)
+
+	wantAdded := map[string]bool{"modified.txt": true, "added.txt": true}
+	if len(added) != len(wantAdded) {
+		t.Fatalf("added = %v, want keys %v", added, wantAdded)
+	}
+	for _, fk := range added {
+		if !wantAdded[fk.Path] {
+			t.Errorf("unexpected entry in added: %v", fk)
+		}
+	}
+
+	wantRemoved := map[string]bool{"modified.txt": true, "removed.txt": true}
+	if len(removed) != len(wantRemoved) {
+		t.Fatalf("removed = %v, want keys %v", removed, wantRemoved)
+	}
+	for _, fk := range removed {
+		if !wantRemoved[fk.Path] {
+			t.Errorf("unexpected entry in removed: %v", fk)
+		}
+	}
+}
+
+func TestCLIRepoSource(t *testing.T) {
+	dir := newTestRepo(t)
+	source := NewCLIRepoSource(dir)
+
+	head, err := source.ResolveRef("master")
+	if err != nil {
+		t.Fatalf("ResolveRef: %v", err)
+	}
+	if head == plumbing.ZeroHash {
+		t.Fatal("ResolveRef(master) returned zero hash")
+	}
+
+	refs, err := source.ListRefs()
+	if err != nil {
+		t.Fatalf("ListRefs: %v", err)
+	}
+	wantRefs := map[string]bool{
+		"refs/heads/master": true,
+		"refs/heads/dev":    true,
+		"refs/tags/v1.0.0":  true,
+	}
+	if len(refs) != len(wantRefs) {
+		t.Fatalf("ListRefs() = %v, want keys %v", refs, wantRefs)
+	}
+	for _, r := range refs {
+		if !wantRefs[r.Name] {
+			t.Errorf("unexpected ref %q", r.Name)
+		}
+	}
+
+	info, err := source.CommitInfo(head)
+	if err != nil {
+		t.Fatalf("CommitInfo: %v", err)
+	}
+	if info.AuthorEmail != "test@example.com" || info.Message != "initial\n" {
+		t.Errorf("CommitInfo = %+v, want author test@example.com and message %q", info, "initial\n")
+	}
+	if len(info.Parents) != 0 {
+		t.Errorf("CommitInfo.Parents = %v, want none for the root commit", info.Parents)
+	}
+
+	entries, err := source.TreeEntries(head)
+	if err != nil {
+		t.Fatalf("TreeEntries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "f.txt" {
+		t.Fatalf("TreeEntries() = %v, want a single f.txt entry", entries)
+	}
+
+	contents, err := source.ReadBlob(entries[0].Hash)
+	if err != nil {
+		t.Fatalf("ReadBlob: %v", err)
+	}
+	if string(contents) != "hello\n" {
+		t.Errorf("ReadBlob() = %q, want %q", contents, "hello\n")
+	}
+}
+
+func TestCLIRepoSourceListRefsEmptyRepo(t *testing.T) {
+	dir := t.TempDir()
+	cmd := exec.Command("git", "init", "-q", "-b", "master", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+
+	refs, err := NewCLIRepoSource(dir).ListRefs()
+	if err != nil {
+		t.Fatalf("ListRefs on empty repo: %v", err)
+	}
+	if len(refs) != 0 {
+		t.Errorf("ListRefs() = %v, want none for an empty repo", refs)
+	}
+}
+
+func TestCLIRepoSourceListRefsNotARepo(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := NewCLIRepoSource(dir).ListRefs(); err == nil {
+		t.Error("ListRefs() in a non-repo directory = nil error, want a failure surfaced to the caller")
+	}
+}
+
+func TestExpandRefSpecs(t *testing.T) {
+	dir := newTestRepo(t)
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := expandRefSpecs(repo, []string{"refs/tags/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"tags/v1.0.0"}
+	if len(got) != len(want) || got[0] != want[0] {
+		t.Errorf("expandRefSpecs() = %v, want %v", got, want)
+	}
+}